@@ -0,0 +1,379 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/core/life"
+	"github.com/juju/juju/worker/catacomb"
+)
+
+const (
+	// rolloutReadinessTimeout bounds how long a staged rollout waits for
+	// enough units to become ready before it rolls back.
+	rolloutReadinessTimeout = 5 * time.Minute
+
+	// rolloutPollInterval is how often readiness is polled while a
+	// rollout is in progress.
+	rolloutPollInterval = 2 * time.Second
+)
+
+// applicationWorker manages the workload of a single application: it
+// reconciles the desired unit count and pod spec against what's observed in
+// the substrate, staging the transition according to the application's
+// chosen UpdateStrategy.
+type applicationWorker struct {
+	catacomb catacomb.Catacomb
+
+	appId              string
+	appRemoved         chan struct{}
+	jujuManagedUnits   bool
+	serviceBroker      ServiceBroker
+	containerBroker    ContainerBroker
+	podSpecGetter      PodSpecGetter
+	lifeGetter         LifeGetter
+	applicationGetter  ApplicationGetter
+	applicationUpdater ApplicationUpdater
+	unitGetter         UnitGetter
+	unitUpdater        UnitUpdater
+	updateStrategy     UpdateStrategy
+	readinessGetter    ReadinessGetter
+
+	// readinessTimeout/readinessPollInterval back waitForNewReady. They
+	// default to rolloutReadinessTimeout/rolloutPollInterval and are only
+	// overridden by tests, so a slow readiness wait doesn't make the test
+	// suite slow.
+	readinessTimeout      time.Duration
+	readinessPollInterval time.Duration
+
+	mu     sync.Mutex
+	report applicationReport
+}
+
+// applicationReport holds the state surfaced by applicationWorker.Report().
+type applicationReport struct {
+	life              life.Value
+	lastEnsureService time.Time
+	podSpecGeneration int
+	desiredUnitCount  int
+	observedUnitCount int
+}
+
+func newApplicationWorker(
+	appId string,
+	appRemoved chan struct{},
+	jujuManagedUnits bool,
+	serviceBroker ServiceBroker,
+	containerBroker ContainerBroker,
+	podSpecGetter PodSpecGetter,
+	lifeGetter LifeGetter,
+	applicationGetter ApplicationGetter,
+	applicationUpdater ApplicationUpdater,
+	unitGetter UnitGetter,
+	unitUpdater UnitUpdater,
+	updateStrategy UpdateStrategy,
+	readinessGetter ReadinessGetter,
+) (*applicationWorker, error) {
+	w := &applicationWorker{
+		appId:                 appId,
+		appRemoved:            appRemoved,
+		jujuManagedUnits:      jujuManagedUnits,
+		serviceBroker:         serviceBroker,
+		containerBroker:       containerBroker,
+		podSpecGetter:         podSpecGetter,
+		lifeGetter:            lifeGetter,
+		applicationGetter:     applicationGetter,
+		applicationUpdater:    applicationUpdater,
+		unitGetter:            unitGetter,
+		unitUpdater:           unitUpdater,
+		updateStrategy:        updateStrategy,
+		readinessGetter:       readinessGetter,
+		readinessTimeout:      rolloutReadinessTimeout,
+		readinessPollInterval: rolloutPollInterval,
+	}
+	err := catacomb.Invoke(catacomb.Plan{
+		Site: &w.catacomb,
+		Work: w.loop,
+	})
+	return w, err
+}
+
+// Kill is part of the worker.Worker interface.
+func (w *applicationWorker) Kill() {
+	w.catacomb.Kill(nil)
+}
+
+// Wait is part of the worker.Worker interface.
+func (w *applicationWorker) Wait() error {
+	return w.catacomb.Wait()
+}
+
+// Report is part of the reporter interface consumed by provisioner.Report,
+// surfacing this application's last observed life, last successful
+// EnsureService timestamp, pod-spec generation and desired/observed unit
+// counts.
+func (w *applicationWorker) Report() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	report := map[string]interface{}{
+		"life":                w.report.life,
+		"pod-spec-generation": w.report.podSpecGeneration,
+		"desired-unit-count":  w.report.desiredUnitCount,
+		"observed-unit-count": w.report.observedUnitCount,
+		"update-strategy":     w.updateStrategy.Kind,
+	}
+	if !w.report.lastEnsureService.IsZero() {
+		report["last-ensure-service"] = w.report.lastEnsureService
+	}
+	return report
+}
+
+func (w *applicationWorker) loop() error {
+	unitsWatcher, err := w.unitGetter.WatchUnits(w.appId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.catacomb.Add(unitsWatcher); err != nil {
+		return errors.Trace(err)
+	}
+	specWatcher, err := w.podSpecGetter.WatchPodSpec(w.appId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.catacomb.Add(specWatcher); err != nil {
+		return errors.Trace(err)
+	}
+
+	for {
+		select {
+		case <-w.catacomb.Dying():
+			return w.catacomb.ErrDying()
+		case <-w.appRemoved:
+			return nil
+		case _, ok := <-unitsWatcher.Changes():
+			if !ok {
+				return errors.New("units watcher closed channel")
+			}
+			if err := w.reconcile(); err != nil {
+				return errors.Trace(err)
+			}
+		case _, ok := <-specWatcher.Changes():
+			if !ok {
+				return errors.New("pod spec watcher closed channel")
+			}
+			w.bumpPodSpecGeneration()
+			if err := w.reconcile(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+}
+
+// reconcile refreshes the application's observed life/unit state and
+// drives the configured UpdateStrategy to bring the workload to the
+// desired unit count.
+func (w *applicationWorker) reconcile() error {
+	appLife, err := w.lifeGetter.Life(w.appId)
+	if err != nil && !errors.IsNotFound(err) {
+		return errors.Trace(err)
+	}
+
+	unitIds, err := w.unitGetter.Units(w.appId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	desired := len(unitIds)
+
+	// baseline is snapshotted before any staged rollout touches the
+	// workload, so a rollout's readiness wait can tell units that were
+	// already ready (the previous generation) apart from ones that became
+	// ready because of this reconcile (the new generation). Counting the
+	// baseline itself as progress would let a rollout "complete" without
+	// a single new unit ever coming up.
+	baseline, err := w.readinessGetter.UnitsReady(w.appId)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	observed := countReady(baseline)
+
+	w.updateReport(appLife, desired, observed)
+	w.reportUnitStatus(baseline)
+
+	switch w.updateStrategy.Kind {
+	case UpdateRollingUpdate:
+		return w.rollingUpdate(desired, observed, baseline)
+	case UpdateBlueGreen:
+		return w.blueGreen(desired, baseline)
+	default:
+		return w.recreate(desired)
+	}
+}
+
+// recreate is the historical, unstaged behaviour: point EnsureService
+// straight at the desired unit count.
+func (w *applicationWorker) recreate(desired int) error {
+	if err := w.ensureService(desired); err != nil {
+		return errors.Trace(err)
+	}
+	w.reportApplicationStatus("active", nil)
+	return nil
+}
+
+// rollingUpdate grows the workload by MaxSurge above desired, then waits for
+// at least MaxSurge units beyond baseline to become ready before settling
+// back down to desired. A failed readiness wait rolls the surge back down to
+// what was already observed, without ever counting the pre-existing
+// (baseline) ready units as evidence the new generation is healthy.
+func (w *applicationWorker) rollingUpdate(desired, observed int, baseline map[string]bool) error {
+	surge := w.updateStrategy.MaxSurge
+	if surge <= 0 {
+		surge = 1
+	}
+	target := desired + surge
+	if err := w.ensureService(target); err != nil {
+		return errors.Trace(err)
+	}
+	w.reportApplicationStatus("waiting", nil)
+	if err := w.waitForNewReady(surge, baseline); err != nil {
+		logger.Errorf("rolling update for application %v failed readiness, rolling back: %v", w.appId, err)
+		if rbErr := w.ensureService(observed); rbErr != nil {
+			logger.Errorf("rollback failed for application %v: %v", w.appId, rbErr)
+		}
+		w.reportApplicationStatus("provisioning failed", err)
+		return nil
+	}
+	if err := w.ensureService(desired); err != nil {
+		return errors.Trace(err)
+	}
+	w.reportApplicationStatus("active", nil)
+	return nil
+}
+
+// blueGreen brings up a full parallel deployment, waits for desired units of
+// the new generation (units ready beyond baseline) to come up, then shifts
+// traffic onto it by unexposing and re-exposing the service before settling
+// on the new generation alone. A failed readiness wait rolls back to the
+// original generation without ever shifting traffic.
+func (w *applicationWorker) blueGreen(desired int, baseline map[string]bool) error {
+	if err := w.ensureService(desired * 2); err != nil {
+		return errors.Trace(err)
+	}
+	w.reportApplicationStatus("waiting", nil)
+	if err := w.waitForNewReady(desired, baseline); err != nil {
+		logger.Errorf("blue/green rollout for application %v failed readiness, rolling back: %v", w.appId, err)
+		if rbErr := w.ensureService(desired); rbErr != nil {
+			logger.Errorf("rollback failed for application %v: %v", w.appId, rbErr)
+		}
+		w.reportApplicationStatus("provisioning failed", err)
+		return nil
+	}
+	if err := w.containerBroker.UnexposeService(w.appId); err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.containerBroker.ExposeService(w.appId); err != nil {
+		return errors.Trace(err)
+	}
+	if err := w.ensureService(desired); err != nil {
+		return errors.Trace(err)
+	}
+	w.reportApplicationStatus("active", nil)
+	return nil
+}
+
+// waitForNewReady blocks until at least minNew units that were not already
+// ready in baseline report ready, the worker is killed, or readinessTimeout
+// elapses.
+func (w *applicationWorker) waitForNewReady(minNew int, baseline map[string]bool) error {
+	deadline := time.Now().Add(w.readinessTimeout)
+	for {
+		current, err := w.readinessGetter.UnitsReady(w.appId)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		newReady := newlyReadyCount(baseline, current)
+		if newReady >= minNew {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("timed out waiting for %d newly ready units, got %d", minNew, newReady)
+		}
+		select {
+		case <-w.catacomb.Dying():
+			return w.catacomb.ErrDying()
+		case <-time.After(w.readinessPollInterval):
+		}
+	}
+}
+
+// countReady returns how many units in ready report ready.
+func countReady(ready map[string]bool) int {
+	count := 0
+	for _, r := range ready {
+		if r {
+			count++
+		}
+	}
+	return count
+}
+
+// newlyReadyCount returns how many units in current are ready but weren't
+// ready in baseline, i.e. units that belong to a generation rolled out since
+// baseline was snapshotted.
+func newlyReadyCount(baseline, current map[string]bool) int {
+	count := 0
+	for unit, ready := range current {
+		if ready && !baseline[unit] {
+			count++
+		}
+	}
+	return count
+}
+
+// ensureService calls through to the ServiceBroker and records the
+// timestamp of the last successful call for Report().
+func (w *applicationWorker) ensureService(numUnits int) error {
+	if err := w.serviceBroker.EnsureService(w.appId, numUnits); err != nil {
+		return errors.Annotatef(err, "ensuring service for application %v", w.appId)
+	}
+	w.mu.Lock()
+	w.report.lastEnsureService = time.Now()
+	w.mu.Unlock()
+	return nil
+}
+
+// reportUnitStatus pushes the currently known per-unit readiness back into
+// Juju's model via UnitUpdater, so units show up with accurate status
+// without waiting on whatever next calls LifeGetter for them.
+func (w *applicationWorker) reportUnitStatus(ready map[string]bool) {
+	if err := w.unitUpdater.UpdateUnits(w.appId, ready); err != nil {
+		logger.Errorf("updating unit status for application %v: %v", w.appId, err)
+	}
+}
+
+// reportApplicationStatus pushes the application's current rollout status
+// back into Juju's model via ApplicationUpdater.
+func (w *applicationWorker) reportApplicationStatus(status string, cause error) {
+	if err := w.applicationUpdater.UpdateApplicationStatus(w.appId, status, cause); err != nil {
+		logger.Errorf("updating status for application %v: %v", w.appId, err)
+	}
+}
+
+func (w *applicationWorker) updateReport(appLife life.Value, desired, observed int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report.life = appLife
+	w.report.desiredUnitCount = desired
+	w.report.observedUnitCount = observed
+}
+
+func (w *applicationWorker) bumpPodSpecGeneration() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.report.podSpecGeneration++
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"time"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+)
+
+type applicationWorkerSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&applicationWorkerSuite{})
+
+// fakeRolloutServiceBroker records every EnsureService call it receives.
+type fakeRolloutServiceBroker struct {
+	ServiceBroker
+	ensureServiceCalls []int
+}
+
+func (b *fakeRolloutServiceBroker) EnsureService(appName string, numUnits int) error {
+	b.ensureServiceCalls = append(b.ensureServiceCalls, numUnits)
+	return nil
+}
+
+// fakeRolloutContainerBroker records whether it was unexposed/re-exposed.
+type fakeRolloutContainerBroker struct {
+	ContainerBroker
+	unexposed bool
+	exposed   bool
+}
+
+func (b *fakeRolloutContainerBroker) UnexposeService(string) error {
+	b.unexposed = true
+	return nil
+}
+
+func (b *fakeRolloutContainerBroker) ExposeService(string) error {
+	b.exposed = true
+	return nil
+}
+
+// fakeReadinessGetter returns a fixed sequence of readiness snapshots, one
+// per call, sticking on the last entry once exhausted.
+type fakeReadinessGetter struct {
+	ReadinessGetter
+	sequence []map[string]bool
+	calls    int
+}
+
+func (g *fakeReadinessGetter) UnitsReady(string) (map[string]bool, error) {
+	i := g.calls
+	if i >= len(g.sequence) {
+		i = len(g.sequence) - 1
+	}
+	g.calls++
+	return g.sequence[i], nil
+}
+
+// fakeApplicationUpdater records every status reported against it.
+type fakeApplicationUpdater struct {
+	ApplicationUpdater
+	statuses []string
+}
+
+func (u *fakeApplicationUpdater) UpdateApplicationStatus(appId, status string, cause error) error {
+	u.statuses = append(u.statuses, status)
+	return nil
+}
+
+type fakeUnitUpdater struct {
+	UnitUpdater
+}
+
+func (u *fakeUnitUpdater) UpdateUnits(string, map[string]bool) error {
+	return nil
+}
+
+func (s *applicationWorkerSuite) TestCountReady(c *gc.C) {
+	c.Assert(countReady(map[string]bool{"a": true, "b": false, "c": true}), gc.Equals, 2)
+	c.Assert(countReady(nil), gc.Equals, 0)
+}
+
+func (s *applicationWorkerSuite) TestNewlyReadyCountIgnoresBaseline(c *gc.C) {
+	baseline := map[string]bool{"mysql/0": true, "mysql/1": true}
+	current := map[string]bool{"mysql/0": true, "mysql/1": true, "mysql/2": true}
+	c.Assert(newlyReadyCount(baseline, current), gc.Equals, 1)
+	c.Assert(newlyReadyCount(baseline, baseline), gc.Equals, 0)
+}
+
+// TestRollingUpdateWaitsForNewGenerationUnits pins the bug this suite exists
+// to catch: a rolling update must not treat units that were already ready
+// before the surge started as evidence the surge itself is healthy.
+func (s *applicationWorkerSuite) TestRollingUpdateWaitsForNewGenerationUnits(c *gc.C) {
+	baseline := map[string]bool{"mysql/0": true, "mysql/1": true}
+	readiness := &fakeReadinessGetter{sequence: []map[string]bool{
+		baseline,
+		{"mysql/0": true, "mysql/1": true, "mysql/2": true},
+	}}
+	svc := &fakeRolloutServiceBroker{}
+	w := &applicationWorker{
+		appId:                 "mysql",
+		serviceBroker:         svc,
+		applicationUpdater:    &fakeApplicationUpdater{},
+		updateStrategy:        UpdateStrategy{Kind: UpdateRollingUpdate, MaxSurge: 1},
+		readinessGetter:       readiness,
+		readinessTimeout:      time.Second,
+		readinessPollInterval: time.Millisecond,
+	}
+
+	err := w.rollingUpdate(2, 2, baseline)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(svc.ensureServiceCalls, gc.DeepEquals, []int{3, 2})
+}
+
+func (s *applicationWorkerSuite) TestRollingUpdateRollsBackWhenNoNewUnitBecomesReady(c *gc.C) {
+	baseline := map[string]bool{"mysql/0": true}
+	readiness := &fakeReadinessGetter{sequence: []map[string]bool{baseline}}
+	svc := &fakeRolloutServiceBroker{}
+	updater := &fakeApplicationUpdater{}
+	w := &applicationWorker{
+		appId:                 "mysql",
+		serviceBroker:         svc,
+		applicationUpdater:    updater,
+		updateStrategy:        UpdateStrategy{Kind: UpdateRollingUpdate, MaxSurge: 1},
+		readinessGetter:       readiness,
+		readinessTimeout:      10 * time.Millisecond,
+		readinessPollInterval: time.Millisecond,
+	}
+
+	err := w.rollingUpdate(1, 1, baseline)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(svc.ensureServiceCalls, gc.DeepEquals, []int{2, 1})
+	c.Assert(updater.statuses[len(updater.statuses)-1], gc.Equals, "provisioning failed")
+}
+
+func (s *applicationWorkerSuite) TestBlueGreenShiftsTrafficOnceNewGenerationReady(c *gc.C) {
+	baseline := map[string]bool{"mysql/0": true}
+	readiness := &fakeReadinessGetter{sequence: []map[string]bool{
+		baseline,
+		{"mysql/0": true, "mysql/1": true},
+	}}
+	svc := &fakeRolloutServiceBroker{}
+	container := &fakeRolloutContainerBroker{}
+	w := &applicationWorker{
+		appId:                 "mysql",
+		serviceBroker:         svc,
+		containerBroker:       container,
+		applicationUpdater:    &fakeApplicationUpdater{},
+		updateStrategy:        UpdateStrategy{Kind: UpdateBlueGreen},
+		readinessGetter:       readiness,
+		readinessTimeout:      time.Second,
+		readinessPollInterval: time.Millisecond,
+	}
+
+	err := w.blueGreen(1, baseline)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(svc.ensureServiceCalls, gc.DeepEquals, []int{2, 1})
+	c.Assert(container.unexposed, jc.IsTrue)
+	c.Assert(container.exposed, jc.IsTrue)
+}
+
+func (s *applicationWorkerSuite) TestBlueGreenRollsBackWithoutShiftingTraffic(c *gc.C) {
+	baseline := map[string]bool{"mysql/0": true}
+	readiness := &fakeReadinessGetter{sequence: []map[string]bool{baseline}}
+	svc := &fakeRolloutServiceBroker{}
+	container := &fakeRolloutContainerBroker{}
+	w := &applicationWorker{
+		appId:                 "mysql",
+		serviceBroker:         svc,
+		containerBroker:       container,
+		applicationUpdater:    &fakeApplicationUpdater{},
+		updateStrategy:        UpdateStrategy{Kind: UpdateBlueGreen},
+		readinessGetter:       readiness,
+		readinessTimeout:      10 * time.Millisecond,
+		readinessPollInterval: time.Millisecond,
+	}
+
+	err := w.blueGreen(1, baseline)
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(svc.ensureServiceCalls, gc.DeepEquals, []int{2, 1})
+	c.Assert(container.unexposed, jc.IsFalse)
+	c.Assert(container.exposed, jc.IsFalse)
+}
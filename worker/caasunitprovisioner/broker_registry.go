@@ -0,0 +1,169 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+
+	"github.com/juju/juju/caas"
+)
+
+// substrateConfigKey is the application config key used to select which
+// registered caas.Provider an application's workload should be provisioned
+// against. When unset, the registry falls back to defaultSubstrate.
+const substrateConfigKey = "juju-substrate"
+
+// defaultSubstrate is assumed for applications that don't specify
+// substrateConfigKey, preserving the historical single-backend behaviour.
+const defaultSubstrate = "kubernetes"
+
+// BrokerRegistry resolves the ServiceBroker and ContainerBroker
+// implementations to use for a given application, allowing a single
+// controller to provision CAAS applications against heterogeneous
+// substrates (Kubernetes, Docker Swarm, Nomad, ECS, ...).
+type BrokerRegistry interface {
+	// ServiceBroker returns the ServiceBroker to use for appId.
+	ServiceBroker(appId string) (ServiceBroker, error)
+
+	// ContainerBroker returns the ContainerBroker to use for appId.
+	ContainerBroker(appId string) (ContainerBroker, error)
+
+	// Forget discards any cached broker mapping for appId. It should be
+	// called once the application's worker has been fully torn down.
+	Forget(appId string)
+
+	// ContainerBrokerForSubstrate returns the ContainerBroker for substrate
+	// directly, without resolving it via an application's current
+	// ApplicationConfig. It exists for cleaning up an application that may
+	// already be entirely gone, so its own ApplicationConfig 404s the same
+	// way its Life does: the caller is expected to have recorded the
+	// substrate it was provisioned against before that happened.
+	ContainerBrokerForSubstrate(substrate string) (ContainerBroker, error)
+}
+
+// brokerSet bundles together the brokers a single caas.Provider exposes.
+type brokerSet struct {
+	service   ServiceBroker
+	container ContainerBroker
+}
+
+// providerBrokerRegistry is the default BrokerRegistry implementation. It
+// resolves an application's substrate from its ApplicationConfig and caches
+// the resulting brokers until the worker is torn down, so that repeated
+// lookups (e.g. the NotFound cleanup path) stay pinned to the substrate the
+// application was originally provisioned against. It also caches a broker
+// per substrate name directly, for ContainerBrokerForSubstrate callers that
+// don't have a live application to resolve config from.
+type providerBrokerRegistry struct {
+	applicationGetter ApplicationGetter
+	providers         map[string]caas.Provider
+	cloudSpec         caas.CloudSpec
+	credential        caas.Credential
+
+	mu               sync.Mutex
+	brokers          map[string]brokerSet
+	substrateBrokers map[string]ContainerBroker
+}
+
+// NewBrokerRegistry returns a BrokerRegistry that picks a caas.Provider from
+// providers (keyed by provider name) based on each application's
+// substrateConfigKey config setting, using cloudSpec/credential to build the
+// brokers.
+func NewBrokerRegistry(
+	applicationGetter ApplicationGetter,
+	providers map[string]caas.Provider,
+	cloudSpec caas.CloudSpec,
+	credential caas.Credential,
+) BrokerRegistry {
+	return &providerBrokerRegistry{
+		applicationGetter: applicationGetter,
+		providers:         providers,
+		cloudSpec:         cloudSpec,
+		credential:        credential,
+		brokers:           make(map[string]brokerSet),
+		substrateBrokers:  make(map[string]ContainerBroker),
+	}
+}
+
+func (r *providerBrokerRegistry) ServiceBroker(appId string) (ServiceBroker, error) {
+	set, err := r.brokersFor(appId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return set.service, nil
+}
+
+func (r *providerBrokerRegistry) ContainerBroker(appId string) (ContainerBroker, error) {
+	set, err := r.brokersFor(appId)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return set.container, nil
+}
+
+func (r *providerBrokerRegistry) Forget(appId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.brokers, appId)
+}
+
+// ContainerBrokerForSubstrate is part of the BrokerRegistry interface.
+func (r *providerBrokerRegistry) ContainerBrokerForSubstrate(substrate string) (ContainerBroker, error) {
+	r.mu.Lock()
+	broker, ok := r.substrateBrokers[substrate]
+	r.mu.Unlock()
+	if ok {
+		return broker, nil
+	}
+
+	provider, ok := r.providers[substrate]
+	if !ok {
+		return nil, errors.NotFoundf("caas provider %q", substrate)
+	}
+	broker, err := provider.NewContainerBroker(r.cloudSpec, r.credential)
+	if err != nil {
+		return nil, errors.Annotatef(err, "creating container broker for substrate %q", substrate)
+	}
+
+	r.mu.Lock()
+	r.substrateBrokers[substrate] = broker
+	r.mu.Unlock()
+	return broker, nil
+}
+
+func (r *providerBrokerRegistry) brokersFor(appId string) (brokerSet, error) {
+	r.mu.Lock()
+	set, ok := r.brokers[appId]
+	r.mu.Unlock()
+	if ok {
+		return set, nil
+	}
+
+	cfg, err := r.applicationGetter.ApplicationConfig(appId)
+	if err != nil {
+		return brokerSet{}, errors.Trace(err)
+	}
+	substrate := cfg.GetString(substrateConfigKey, defaultSubstrate)
+	provider, ok := r.providers[substrate]
+	if !ok {
+		return brokerSet{}, errors.NotFoundf("caas provider %q for application %q", substrate, appId)
+	}
+
+	service, err := provider.NewServiceBroker(r.cloudSpec, r.credential)
+	if err != nil {
+		return brokerSet{}, errors.Annotatef(err, "creating service broker for %q", appId)
+	}
+	container, err := provider.NewContainerBroker(r.cloudSpec, r.credential)
+	if err != nil {
+		return brokerSet{}, errors.Annotatef(err, "creating container broker for %q", appId)
+	}
+
+	set = brokerSet{service: service, container: container}
+	r.mu.Lock()
+	r.brokers[appId] = set
+	r.mu.Unlock()
+	return set, nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	stdtesting "testing"
+
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju/caas"
+	"github.com/juju/juju/core/application"
+)
+
+func Test(t *stdtesting.T) {
+	gc.TestingT(t)
+}
+
+type brokerRegistrySuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&brokerRegistrySuite{})
+
+// fakeApplicationGetter is the minimal ApplicationGetter the broker registry
+// actually calls: ApplicationConfig to resolve a substrate.
+type fakeApplicationGetter struct {
+	ApplicationGetter
+	configs map[string]application.ConfigAttributes
+}
+
+func (f *fakeApplicationGetter) ApplicationConfig(appId string) (application.ConfigAttributes, error) {
+	return f.configs[appId], nil
+}
+
+// fakeServiceBroker/fakeContainerBroker are no-op brokers, just enough to
+// prove providerBrokerRegistry wires a given caas.Provider's brokers
+// through unmodified and caches them per application.
+type fakeServiceBroker struct {
+	ServiceBroker
+	id string
+}
+
+type fakeContainerBroker struct {
+	ContainerBroker
+	id string
+}
+
+// fakeProvider hands back brokers tagged with its own name, so a test can
+// assert which provider ended up resolved for a given application.
+type fakeProvider struct {
+	caas.Provider
+	name         string
+	newBrokerErr error
+}
+
+func (p *fakeProvider) NewServiceBroker(caas.CloudSpec, caas.Credential) (ServiceBroker, error) {
+	if p.newBrokerErr != nil {
+		return nil, p.newBrokerErr
+	}
+	return &fakeServiceBroker{id: p.name}, nil
+}
+
+func (p *fakeProvider) NewContainerBroker(caas.CloudSpec, caas.Credential) (ContainerBroker, error) {
+	if p.newBrokerErr != nil {
+		return nil, p.newBrokerErr
+	}
+	return &fakeContainerBroker{id: p.name}, nil
+}
+
+func (s *brokerRegistrySuite) TestResolvesConfiguredSubstrate(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{
+		"mysql": {substrateConfigKey: "swarm"},
+	}}
+	providers := map[string]caas.Provider{
+		"kubernetes": &fakeProvider{name: "kubernetes"},
+		"swarm":      &fakeProvider{name: "swarm"},
+	}
+	registry := NewBrokerRegistry(getter, providers, caas.CloudSpec{}, caas.Credential{})
+
+	service, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(service.(*fakeServiceBroker).id, gc.Equals, "swarm")
+}
+
+func (s *brokerRegistrySuite) TestDefaultsToKubernetes(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{
+		"mysql": {},
+	}}
+	providers := map[string]caas.Provider{
+		"kubernetes": &fakeProvider{name: "kubernetes"},
+	}
+	registry := NewBrokerRegistry(getter, providers, caas.CloudSpec{}, caas.Credential{})
+
+	container, err := registry.ContainerBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(container.(*fakeContainerBroker).id, gc.Equals, "kubernetes")
+}
+
+func (s *brokerRegistrySuite) TestUnknownSubstrate(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{
+		"mysql": {substrateConfigKey: "nomad"},
+	}}
+	providers := map[string]caas.Provider{
+		"kubernetes": &fakeProvider{name: "kubernetes"},
+	}
+	registry := NewBrokerRegistry(getter, providers, caas.CloudSpec{}, caas.Credential{})
+
+	_, err := registry.ServiceBroker("mysql")
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *brokerRegistrySuite) TestCachesResolvedBrokers(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{
+		"mysql": {},
+	}}
+	provider := &fakeProvider{name: "kubernetes"}
+	registry := NewBrokerRegistry(getter, map[string]caas.Provider{"kubernetes": provider}, caas.CloudSpec{}, caas.Credential{})
+
+	first, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	second, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(first, gc.Equals, second)
+}
+
+func (s *brokerRegistrySuite) TestForgetDropsCache(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{
+		"mysql": {},
+	}}
+	provider := &fakeProvider{name: "kubernetes"}
+	registry := NewBrokerRegistry(getter, map[string]caas.Provider{"kubernetes": provider}, caas.CloudSpec{}, caas.Credential{})
+
+	first, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	registry.Forget("mysql")
+	second, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(first, gc.Not(gc.Equals), second)
+}
+
+func (s *brokerRegistrySuite) TestContainerBrokerForSubstrateBypassesApplicationConfig(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{}}
+	provider := &fakeProvider{name: "kubernetes"}
+	registry := NewBrokerRegistry(getter, map[string]caas.Provider{"kubernetes": provider}, caas.CloudSpec{}, caas.Credential{})
+
+	broker, err := registry.ContainerBrokerForSubstrate("kubernetes")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(broker.(*fakeContainerBroker).id, gc.Equals, "kubernetes")
+}
+
+func (s *brokerRegistrySuite) TestContainerBrokerForSubstrateUnknown(c *gc.C) {
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{}}
+	registry := NewBrokerRegistry(getter, map[string]caas.Provider{}, caas.CloudSpec{}, caas.Credential{})
+
+	_, err := registry.ContainerBrokerForSubstrate("nomad")
+	c.Assert(err, gc.NotNil)
+}
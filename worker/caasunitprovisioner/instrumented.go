@@ -0,0 +1,118 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"time"
+
+	"github.com/juju/juju/watcher"
+)
+
+// instrumentedServiceBroker wraps a ServiceBroker, recording call latency
+// and failure counts against metrics so they surface via the Prometheus
+// collectors that NewWorker registers.
+type instrumentedServiceBroker struct {
+	ServiceBroker
+	metrics *brokerMetrics
+}
+
+func newInstrumentedServiceBroker(broker ServiceBroker, metrics *brokerMetrics) ServiceBroker {
+	return &instrumentedServiceBroker{ServiceBroker: broker, metrics: metrics}
+}
+
+// EnsureService is part of the ServiceBroker interface.
+func (b *instrumentedServiceBroker) EnsureService(appName string, numUnits int) error {
+	start := time.Now()
+	err := b.ServiceBroker.EnsureService(appName, numUnits)
+	b.metrics.observe("EnsureService", start, err)
+	return err
+}
+
+// instrumentedContainerBroker wraps a ContainerBroker, recording call
+// latency and failure counts against metrics.
+type instrumentedContainerBroker struct {
+	ContainerBroker
+	metrics *brokerMetrics
+}
+
+func newInstrumentedContainerBroker(broker ContainerBroker, metrics *brokerMetrics) ContainerBroker {
+	return &instrumentedContainerBroker{ContainerBroker: broker, metrics: metrics}
+}
+
+// UnexposeService is part of the ContainerBroker interface.
+func (b *instrumentedContainerBroker) UnexposeService(appName string) error {
+	start := time.Now()
+	err := b.ContainerBroker.UnexposeService(appName)
+	b.metrics.observe("UnexposeService", start, err)
+	return err
+}
+
+// DeleteService is part of the ContainerBroker interface.
+func (b *instrumentedContainerBroker) DeleteService(appName string) error {
+	start := time.Now()
+	err := b.ContainerBroker.DeleteService(appName)
+	b.metrics.observe("DeleteService", start, err)
+	return err
+}
+
+// instrumentedBrokerRegistry wraps a BrokerRegistry so that every broker it
+// resolves has its calls recorded against metrics, regardless of how the
+// underlying registry builds those brokers.
+type instrumentedBrokerRegistry struct {
+	BrokerRegistry
+	metrics *brokerMetrics
+}
+
+// newInstrumentedBrokerRegistry wraps registry so brokers it resolves report
+// call latency/failures via metrics. It is installed by NewWorker.
+func newInstrumentedBrokerRegistry(registry BrokerRegistry, metrics *brokerMetrics) BrokerRegistry {
+	return &instrumentedBrokerRegistry{BrokerRegistry: registry, metrics: metrics}
+}
+
+// ServiceBroker is part of the BrokerRegistry interface.
+func (r *instrumentedBrokerRegistry) ServiceBroker(appId string) (ServiceBroker, error) {
+	broker, err := r.BrokerRegistry.ServiceBroker(appId)
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedServiceBroker(broker, r.metrics), nil
+}
+
+// ContainerBroker is part of the BrokerRegistry interface.
+func (r *instrumentedBrokerRegistry) ContainerBroker(appId string) (ContainerBroker, error) {
+	broker, err := r.BrokerRegistry.ContainerBroker(appId)
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedContainerBroker(broker, r.metrics), nil
+}
+
+// ContainerBrokerForSubstrate is part of the BrokerRegistry interface.
+func (r *instrumentedBrokerRegistry) ContainerBrokerForSubstrate(substrate string) (ContainerBroker, error) {
+	broker, err := r.BrokerRegistry.ContainerBrokerForSubstrate(substrate)
+	if err != nil {
+		return nil, err
+	}
+	return newInstrumentedContainerBroker(broker, r.metrics), nil
+}
+
+// instrumentedApplicationGetter wraps an ApplicationGetter, recording call
+// latency and failure counts for WatchApplications against metrics.
+// ApplicationConfig passes straight through via the embedded getter.
+type instrumentedApplicationGetter struct {
+	ApplicationGetter
+	metrics *brokerMetrics
+}
+
+func newInstrumentedApplicationGetter(getter ApplicationGetter, metrics *brokerMetrics) ApplicationGetter {
+	return &instrumentedApplicationGetter{ApplicationGetter: getter, metrics: metrics}
+}
+
+// WatchApplications is part of the ApplicationGetter interface.
+func (g *instrumentedApplicationGetter) WatchApplications() (watcher.StringsWatcher, error) {
+	start := time.Now()
+	w, err := g.ApplicationGetter.WatchApplications()
+	g.metrics.observe("WatchApplications", start, err)
+	return w, err
+}
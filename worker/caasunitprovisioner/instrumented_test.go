@@ -0,0 +1,131 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gc "gopkg.in/check.v1"
+
+	"github.com/juju/juju/caas"
+	"github.com/juju/juju/core/application"
+	"github.com/juju/juju/watcher"
+)
+
+type instrumentedSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&instrumentedSuite{})
+
+// stubServiceBroker/stubContainerBroker return a configured error from every
+// call, so both the success and failure metrics paths can be exercised.
+type stubServiceBroker struct {
+	ServiceBroker
+	err error
+}
+
+func (b *stubServiceBroker) EnsureService(string, int) error {
+	return b.err
+}
+
+type stubContainerBroker struct {
+	ContainerBroker
+	err error
+}
+
+func (b *stubContainerBroker) UnexposeService(string) error {
+	return b.err
+}
+
+func (b *stubContainerBroker) DeleteService(string) error {
+	return b.err
+}
+
+// stubApplicationGetter returns a configured watcher/error pair from
+// WatchApplications.
+type stubApplicationGetter struct {
+	ApplicationGetter
+	watcher watcher.StringsWatcher
+	err     error
+}
+
+func (g *stubApplicationGetter) WatchApplications() (watcher.StringsWatcher, error) {
+	return g.watcher, g.err
+}
+
+type stubStringsWatcher struct {
+	changes chan []string
+}
+
+func (w *stubStringsWatcher) Kill()                    {}
+func (w *stubStringsWatcher) Wait() error              { return nil }
+func (w *stubStringsWatcher) Changes() <-chan []string { return w.changes }
+
+func (s *instrumentedSuite) TestInstrumentedServiceBrokerRecordsSuccess(c *gc.C) {
+	metrics := newBrokerMetrics()
+	broker := newInstrumentedServiceBroker(&stubServiceBroker{}, metrics)
+
+	c.Assert(broker.EnsureService("mysql", 3), jc.ErrorIsNil)
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("EnsureService")), gc.Equals, float64(0))
+}
+
+func (s *instrumentedSuite) TestInstrumentedServiceBrokerRecordsFailure(c *gc.C) {
+	metrics := newBrokerMetrics()
+	failure := errors.New("boom")
+	broker := newInstrumentedServiceBroker(&stubServiceBroker{err: failure}, metrics)
+
+	c.Assert(broker.EnsureService("mysql", 3), gc.Equals, failure)
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("EnsureService")), gc.Equals, float64(1))
+}
+
+func (s *instrumentedSuite) TestInstrumentedContainerBrokerRecordsEachOperation(c *gc.C) {
+	metrics := newBrokerMetrics()
+	failure := errors.New("boom")
+	broker := newInstrumentedContainerBroker(&stubContainerBroker{err: failure}, metrics)
+
+	c.Assert(broker.UnexposeService("mysql"), gc.Equals, failure)
+	c.Assert(broker.DeleteService("mysql"), gc.Equals, failure)
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("UnexposeService")), gc.Equals, float64(1))
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("DeleteService")), gc.Equals, float64(1))
+}
+
+func (s *instrumentedSuite) TestInstrumentedApplicationGetterRecordsWatchApplications(c *gc.C) {
+	metrics := newBrokerMetrics()
+	failure := errors.New("boom")
+	getter := newInstrumentedApplicationGetter(&stubApplicationGetter{err: failure}, metrics)
+
+	_, err := getter.WatchApplications()
+	c.Assert(err, gc.Equals, failure)
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("WatchApplications")), gc.Equals, float64(1))
+}
+
+func (s *instrumentedSuite) TestInstrumentedApplicationGetterPassesThroughWatcher(c *gc.C) {
+	metrics := newBrokerMetrics()
+	underlying := &stubStringsWatcher{changes: make(chan []string)}
+	getter := newInstrumentedApplicationGetter(&stubApplicationGetter{watcher: underlying}, metrics)
+
+	w, err := getter.WatchApplications()
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(w, gc.Equals, underlying)
+	c.Assert(testutil.ToFloat64(metrics.callFailures.WithLabelValues("WatchApplications")), gc.Equals, float64(0))
+}
+
+func (s *instrumentedSuite) TestInstrumentedBrokerRegistryWrapsResolvedBrokers(c *gc.C) {
+	metrics := newBrokerMetrics()
+	provider := &fakeProvider{name: "kubernetes"}
+	getter := &fakeApplicationGetter{configs: map[string]application.ConfigAttributes{"mysql": {}}}
+	inner := NewBrokerRegistry(getter, map[string]caas.Provider{"kubernetes": provider}, caas.CloudSpec{}, caas.Credential{})
+	registry := newInstrumentedBrokerRegistry(inner, metrics)
+
+	service, err := registry.ServiceBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(service, gc.FitsTypeOf, &instrumentedServiceBroker{})
+
+	container, err := registry.ContainerBroker("mysql")
+	c.Assert(err, jc.ErrorIsNil)
+	c.Assert(container, gc.FitsTypeOf, &instrumentedContainerBroker{})
+}
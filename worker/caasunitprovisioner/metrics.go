@@ -0,0 +1,63 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "juju"
+	metricsSubsystem = "caasunitprovisioner"
+)
+
+// brokerMetrics holds the Prometheus collectors used to report broker call
+// latency and failures for each operation (EnsureService, UnexposeService,
+// DeleteService, WatchApplications) performed against a CAAS substrate.
+type brokerMetrics struct {
+	callDuration *prometheus.HistogramVec
+	callFailures *prometheus.CounterVec
+}
+
+// newBrokerMetrics creates the collectors used by instrumented brokers. The
+// caller is responsible for registering the returned collectors with a
+// prometheus.Registerer.
+func newBrokerMetrics() *brokerMetrics {
+	return &brokerMetrics{
+		callDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "broker_call_duration_seconds",
+			Help:      "Time taken to complete a CAAS broker operation.",
+		}, []string{"operation"}),
+		callFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "broker_call_failures_total",
+			Help:      "Count of failed CAAS broker operation calls.",
+		}, []string{"operation"}),
+	}
+}
+
+// Describe is part of the prometheus.Collector interface.
+func (m *brokerMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.callDuration.Describe(ch)
+	m.callFailures.Describe(ch)
+}
+
+// Collect is part of the prometheus.Collector interface.
+func (m *brokerMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.callDuration.Collect(ch)
+	m.callFailures.Collect(ch)
+}
+
+// observe records the outcome of a single broker call against operation.
+func (m *brokerMetrics) observe(operation string, start time.Time, err error) {
+	m.callDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.callFailures.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/utils/clock"
+)
+
+const (
+	// retryCheckInterval is how often the loop wakes up to re-attempt
+	// applications whose backoff has elapsed, independent of any new
+	// watcher event.
+	retryCheckInterval = 10 * time.Second
+
+	initialRetryDelay = 5 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+
+	// circuitBreakerThreshold is the number of consecutive transient
+	// failures after which an application is reported as failed instead
+	// of retried on the normal backoff schedule.
+	circuitBreakerThreshold = 6
+
+	// circuitBreakerCooldown is how long a tripped circuit stays fully
+	// open before a single half-open probe attempt is allowed through.
+	// A successful probe (RecordSuccess) closes the circuit; a failed one
+	// re-trips it and restarts the cooldown.
+	circuitBreakerCooldown = 2 * time.Minute
+)
+
+// retryState tracks the backoff and circuit breaker state for a single
+// application. tripped is informational only (surfaced via Report()/logs);
+// nextAttempt is what actually gates retries, so a tripped circuit still
+// gets a half-open probe once its cooldown elapses instead of being stuck
+// until process restart.
+type retryState struct {
+	consecutiveFailures int
+	nextAttempt         time.Time
+	tripped             bool
+}
+
+// retryTracker implements per-application exponential backoff with jitter,
+// and trips a circuit breaker after circuitBreakerThreshold consecutive
+// failures so a permanently broken substrate stops being hammered.
+type retryTracker struct {
+	clock clock.Clock
+
+	mu    sync.Mutex
+	state map[string]*retryState
+}
+
+func newRetryTracker(clk clock.Clock) *retryTracker {
+	return &retryTracker{
+		clock: clk,
+		state: make(map[string]*retryState),
+	}
+}
+
+// ShouldAttempt reports whether appId may be (re)processed now: either it
+// has no recorded failures, or its backoff/cooldown has elapsed. A tripped
+// circuit is still retried once its cooldown passes, as a half-open probe.
+func (t *retryTracker) ShouldAttempt(appId string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.state[appId]
+	if !ok {
+		return true
+	}
+	return !t.clock.Now().Before(s.nextAttempt)
+}
+
+// RecordSuccess clears any failure/backoff/circuit-breaker state held for
+// appId.
+func (t *retryTracker) RecordSuccess(appId string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.state, appId)
+}
+
+// RecordFailure registers a failed operation for appId. Below
+// circuitBreakerThreshold it schedules the next retry with exponential
+// backoff and jitter; at the threshold it trips the circuit and schedules a
+// single half-open probe after circuitBreakerCooldown. It reports whether
+// the circuit breaker has just tripped, in which case the caller should
+// surface the application as failed (retries continue regardless, as
+// half-open probes, so a substrate that recovers is noticed without a
+// process restart).
+func (t *retryTracker) RecordFailure(appId string) (tripped bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.state[appId]
+	if !ok {
+		s = &retryState{}
+		t.state[appId] = s
+	}
+	s.consecutiveFailures++
+	if s.consecutiveFailures >= circuitBreakerThreshold {
+		wasTripped := s.tripped
+		s.tripped = true
+		s.nextAttempt = t.clock.Now().Add(circuitBreakerCooldown)
+		return !wasTripped
+	}
+	s.nextAttempt = t.clock.Now().Add(backoff(s.consecutiveFailures))
+	return false
+}
+
+// IsTripped reports whether appId's circuit breaker is currently open. It is
+// purely informational (for logging/introspection): ShouldAttempt/Due still
+// let a tripped application through once its cooldown elapses.
+func (t *retryTracker) IsTripped(appId string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.state[appId]
+	return ok && s.tripped
+}
+
+// Due returns the applications whose backoff or circuit-breaker cooldown
+// has elapsed and are therefore ready to be (re)attempted.
+func (t *retryTracker) Due() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	var due []string
+	for appId, s := range t.state {
+		if !now.Before(s.nextAttempt) {
+			due = append(due, appId)
+		}
+	}
+	return due
+}
+
+// backoff computes an exponential delay with jitter for the given failure
+// count, capped at maxRetryDelay.
+func backoff(failures int) time.Duration {
+	delay := initialRetryDelay * time.Duration(1<<uint(failures-1))
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 2))
+	return delay/2 + jitter
+}
+
+// isTransient reports whether err is worth retrying. Non-transient errors
+// (auth failures, not-found on delete) should short-circuit instead of
+// burning through the retry budget.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.IsNotFound(err) || errors.IsUnauthorized(err) || errors.IsNotValid(err) || errors.IsForbidden(err) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package caasunitprovisioner
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/utils/clock"
+	gc "gopkg.in/check.v1"
+)
+
+type retryTrackerSuite struct {
+	testing.IsolationSuite
+}
+
+var _ = gc.Suite(&retryTrackerSuite{})
+
+// manualClock is a minimal clock.Clock whose Now() is advanced explicitly,
+// so backoff/cooldown math can be tested deterministically.
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time                              { return c.now }
+func (c *manualClock) After(time.Duration) <-chan time.Time        { panic("not used by retryTracker") }
+func (c *manualClock) AfterFunc(time.Duration, func()) clock.Timer { panic("not used by retryTracker") }
+func (c *manualClock) NewTimer(time.Duration) clock.Timer          { panic("not used by retryTracker") }
+
+func (c *manualClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestClock() *manualClock {
+	return &manualClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (s *retryTrackerSuite) TestShouldAttemptUnknownApp(c *gc.C) {
+	tracker := newRetryTracker(newTestClock())
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsTrue)
+}
+
+func (s *retryTrackerSuite) TestBacksOffAfterFailure(c *gc.C) {
+	clk := newTestClock()
+	tracker := newRetryTracker(clk)
+
+	tracker.RecordFailure("mysql")
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsFalse)
+
+	clk.advance(maxRetryDelay)
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsTrue)
+}
+
+func (s *retryTrackerSuite) TestRecordSuccessClearsState(c *gc.C) {
+	clk := newTestClock()
+	tracker := newRetryTracker(clk)
+
+	tracker.RecordFailure("mysql")
+	tracker.RecordSuccess("mysql")
+
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsTrue)
+	c.Assert(tracker.IsTripped("mysql"), jc.IsFalse)
+}
+
+func (s *retryTrackerSuite) TestTripsCircuitBreaker(c *gc.C) {
+	clk := newTestClock()
+	tracker := newRetryTracker(clk)
+
+	var tripped bool
+	for i := 0; i < circuitBreakerThreshold; i++ {
+		tripped = tracker.RecordFailure("mysql")
+		clk.advance(maxRetryDelay)
+	}
+	c.Assert(tripped, jc.IsTrue)
+	c.Assert(tracker.IsTripped("mysql"), jc.IsTrue)
+
+	// RecordFailure should not repeatedly report "just tripped" for an
+	// already-open circuit.
+	c.Assert(tracker.RecordFailure("mysql"), jc.IsFalse)
+}
+
+func (s *retryTrackerSuite) TestHalfOpenProbeAfterCooldown(c *gc.C) {
+	clk := newTestClock()
+	tracker := newRetryTracker(clk)
+
+	for i := 0; i < circuitBreakerThreshold; i++ {
+		tracker.RecordFailure("mysql")
+	}
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsFalse)
+
+	clk.advance(circuitBreakerCooldown)
+	c.Assert(tracker.ShouldAttempt("mysql"), jc.IsTrue)
+
+	// A successful probe closes the circuit.
+	tracker.RecordSuccess("mysql")
+	c.Assert(tracker.IsTripped("mysql"), jc.IsFalse)
+}
+
+func (s *retryTrackerSuite) TestDueReturnsElapsedApps(c *gc.C) {
+	clk := newTestClock()
+	tracker := newRetryTracker(clk)
+
+	tracker.RecordFailure("mysql")
+	tracker.RecordFailure("wordpress")
+
+	c.Assert(tracker.Due(), gc.HasLen, 0)
+
+	clk.advance(maxRetryDelay)
+	c.Assert(tracker.Due(), gc.HasLen, 2)
+}
+
+func (s *retryTrackerSuite) TestIsTransient(c *gc.C) {
+	c.Assert(isTransient(nil), jc.IsFalse)
+	c.Assert(isTransient(errors.NotFoundf("application")), jc.IsFalse)
+	c.Assert(isTransient(errors.Unauthorizedf("no access")), jc.IsFalse)
+	c.Assert(isTransient(errors.New("connection reset by peer")), jc.IsTrue)
+}
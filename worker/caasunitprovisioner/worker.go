@@ -8,6 +8,8 @@ import (
 
 	"github.com/juju/errors"
 	"github.com/juju/loggo"
+	"github.com/juju/utils/clock"
+	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/juju/worker.v1"
 
 	"github.com/juju/juju/caas"
@@ -21,13 +23,25 @@ var logger = loggo.GetLogger("juju.workers.caasunitprovisioner")
 type Config struct {
 	ApplicationGetter  ApplicationGetter
 	ApplicationUpdater ApplicationUpdater
-	ServiceBroker      ServiceBroker
 
-	ContainerBroker ContainerBroker
+	// Brokers resolves the ServiceBroker/ContainerBroker pair to use for
+	// each application, allowing applications to be provisioned against
+	// different CAAS substrates from the same worker.
+	Brokers BrokerRegistry
+
 	PodSpecGetter   PodSpecGetter
 	LifeGetter      LifeGetter
 	UnitGetter      UnitGetter
 	UnitUpdater     UnitUpdater
+	ReadinessGetter ReadinessGetter
+
+	// PrometheusRegisterer, if set, is used to register the collectors
+	// that back the per-operation broker call metrics. It is optional so
+	// that tests can construct a Config without a Prometheus registry.
+	PrometheusRegisterer prometheus.Registerer
+
+	// Clock is used for computing retry backoff. Defaults to clock.WallClock.
+	Clock clock.Clock
 }
 
 // Validate validates the worker configuration.
@@ -38,11 +52,8 @@ func (config Config) Validate() error {
 	if config.ApplicationUpdater == nil {
 		return errors.NotValidf("missing ApplicationUpdater")
 	}
-	if config.ServiceBroker == nil {
-		return errors.NotValidf("missing ServiceBroker")
-	}
-	if config.ContainerBroker == nil {
-		return errors.NotValidf("missing ContainerBroker")
+	if config.Brokers == nil {
+		return errors.NotValidf("missing Brokers")
 	}
 	if config.PodSpecGetter == nil {
 		return errors.NotValidf("missing PodSpecGetter")
@@ -56,6 +67,9 @@ func (config Config) Validate() error {
 	if config.UnitUpdater == nil {
 		return errors.NotValidf("missing UnitUpdater")
 	}
+	if config.ReadinessGetter == nil {
+		return errors.NotValidf("missing ReadinessGetter")
+	}
 	return nil
 }
 
@@ -64,7 +78,22 @@ func NewWorker(config Config) (worker.Worker, error) {
 	if err := config.Validate(); err != nil {
 		return nil, errors.Trace(err)
 	}
-	p := &provisioner{config: config}
+	if config.PrometheusRegisterer != nil {
+		metrics := newBrokerMetrics()
+		if err := config.PrometheusRegisterer.Register(metrics); err != nil {
+			return nil, errors.Annotate(err, "registering caasunitprovisioner metrics")
+		}
+		config.Brokers = newInstrumentedBrokerRegistry(config.Brokers, metrics)
+		config.ApplicationGetter = newInstrumentedApplicationGetter(config.ApplicationGetter, metrics)
+	}
+	if config.Clock == nil {
+		config.Clock = clock.WallClock
+	}
+	p := &provisioner{
+		config:           config,
+		retries:          newRetryTracker(config.Clock),
+		pendingDeletions: make(map[string]string),
+	}
 	err := catacomb.Invoke(catacomb.Plan{
 		Site: &p.catacomb,
 		Work: p.loop,
@@ -72,6 +101,15 @@ func NewWorker(config Config) (worker.Worker, error) {
 	return p, err
 }
 
+// PendingDeletion records that an application's cleanup (UnexposeService and
+// DeleteService) is in flight, along with the substrate it was provisioned
+// against so that cleanup can be resumed without depending on the
+// application's own (possibly already-gone) ApplicationConfig.
+type PendingDeletion struct {
+	AppId     string
+	Substrate string
+}
+
 type provisioner struct {
 	catacomb catacomb.Catacomb
 	config   Config
@@ -80,6 +118,19 @@ type provisioner struct {
 	// It's defined here so that we can access it in tests.
 	appWorkers map[string]*applicationWorker
 	mu         sync.Mutex
+
+	// retries tracks backoff and circuit breaker state per application, so
+	// a flaky broker doesn't bounce the whole worker.
+	retries *retryTracker
+
+	// pendingDeletions is an in-memory mirror, keyed by appId, of the
+	// substrate each in-flight cleanup was provisioned against. The
+	// authoritative copy is persisted via ApplicationUpdater.SetPendingDeletion/
+	// ClearPendingDeletion, so a restart doesn't depend on the watcher
+	// redelivering removed applications (which generally doesn't happen):
+	// resumePendingDeletions reloads it from there on startup and resumes
+	// cleanup before the main loop starts watching for new changes.
+	pendingDeletions map[string]string
 }
 
 // Kill is part of the worker.Worker interface.
@@ -92,6 +143,28 @@ func (p *provisioner) Wait() error {
 	return p.catacomb.Wait()
 }
 
+// Report is part of the worker/introspection Reporter interface. It exposes
+// the applications currently tracked by the provisioner, each one's own
+// applicationWorker.Report(), so CAAS state shows up under
+// /depengine/caasunitprovisioner/* and in juju_engine_report.
+func (p *provisioner) Report() map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	apps := make(map[string]interface{}, len(p.appWorkers))
+	for appId, aw := range p.appWorkers {
+		apps[appId] = aw.Report()
+	}
+	pending := make([]string, 0, len(p.pendingDeletions))
+	for appId := range p.pendingDeletions {
+		pending = append(pending, appId)
+	}
+	return map[string]interface{}{
+		"applications":      apps,
+		"pending-deletions": pending,
+	}
+}
+
 // These helper methods protect the appWorkers map so we can access for testing.
 
 func (p *provisioner) saveApplicationWorker(appName string, aw *applicationWorker) {
@@ -123,6 +196,10 @@ func (p *provisioner) getApplicationWorker(appName string) (*applicationWorker,
 }
 
 func (p *provisioner) loop() error {
+	if err := p.resumePendingDeletions(); err != nil {
+		return errors.Trace(err)
+	}
+
 	w, err := p.config.ApplicationGetter.WatchApplications()
 	if err != nil {
 		return errors.Trace(err)
@@ -131,6 +208,9 @@ func (p *provisioner) loop() error {
 		return errors.Trace(err)
 	}
 
+	retryTimer := p.config.Clock.NewTimer(retryCheckInterval)
+	defer retryTimer.Stop()
+
 	for {
 		select {
 		case <-p.catacomb.Dying():
@@ -140,70 +220,260 @@ func (p *provisioner) loop() error {
 				return errors.New("watcher closed channel")
 			}
 			for _, appId := range apps {
-				appLife, err := p.config.LifeGetter.Life(appId)
-				if errors.IsNotFound(err) {
-					// Once an application is deleted, remove the k8s service and ingress resources.
-					if err := p.config.ContainerBroker.UnexposeService(appId); err != nil {
-						return errors.Trace(err)
-					}
-					if err := p.config.ContainerBroker.DeleteService(appId); err != nil {
-						return errors.Trace(err)
-					}
-					w, ok := p.getApplicationWorker(appId)
-					if ok {
-						// Before stopping the application worker, inform it that
-						// the app is gone so it has a chance to clean up.
-						// The worker will act on the removal prior to processing the
-						// Stop() request.
-						// We have to use a channel send here, rather than just closing the select, otherwise we
-						// effectively send the Stop() at the same time as the appRemoved signal.
-						// By sending a message, we block until it at least starts that routine
-						select {
-						case w.appRemoved <- struct{}{}:
-						case <-w.catacomb.Dying():
-							// If the catacomb is already dying, there is no guarantee that w.appRemoved will ever be
-							// seen. But we can still at least close the channel
-							close(w.appRemoved)
-						}
-						if err := worker.Stop(w); err != nil {
-							logger.Errorf("stopping application worker for %v: %v", appId, err)
-						}
-						p.deleteApplicationWorker(appId)
-					}
-					continue
-				}
-				if err != nil {
-					return errors.Trace(err)
-				}
-				if _, ok := p.getApplicationWorker(appId); ok || appLife == life.Dead {
-					// Already watching the application. or we're
-					// not yet watching it and it's dead.
-					continue
-				}
-				cfg, err := p.config.ApplicationGetter.ApplicationConfig(appId)
-				if err != nil {
+				if err := p.processApp(appId); err != nil {
 					return errors.Trace(err)
 				}
-				jujuManagedUnits := cfg.GetBool(caas.JujuManagedUnits, false)
-				w, err := newApplicationWorker(
-					appId,
-					make(chan struct{}),
-					jujuManagedUnits,
-					p.config.ServiceBroker,
-					p.config.ContainerBroker,
-					p.config.PodSpecGetter,
-					p.config.LifeGetter,
-					p.config.ApplicationGetter,
-					p.config.ApplicationUpdater,
-					p.config.UnitGetter,
-					p.config.UnitUpdater,
-				)
-				if err != nil {
+			}
+		case <-retryTimer.Chan():
+			for _, appId := range p.retries.Due() {
+				if err := p.processApp(appId); err != nil {
 					return errors.Trace(err)
 				}
-				p.saveApplicationWorker(appId, w)
-				p.catacomb.Add(w)
 			}
+			retryTimer.Reset(retryCheckInterval)
 		}
 	}
 }
+
+// processApp reconciles a single application against its current life,
+// deferring to its retry/circuit-breaker state so that a broker failure for
+// one application never bounces the worker for every other application it
+// manages.
+func (p *provisioner) processApp(appId string) error {
+	if !p.retries.ShouldAttempt(appId) {
+		return nil
+	}
+
+	appLife, err := p.config.LifeGetter.Life(appId)
+	if errors.IsNotFound(err) {
+		return p.processAppRemoved(appId)
+	}
+	if err != nil {
+		return p.handleAppError(appId, err)
+	}
+	if _, ok := p.getApplicationWorker(appId); ok || appLife == life.Dead {
+		// Already watching the application. or we're
+		// not yet watching it and it's dead.
+		p.retries.RecordSuccess(appId)
+		return nil
+	}
+
+	cfg, err := p.config.ApplicationGetter.ApplicationConfig(appId)
+	if err != nil {
+		return p.handleAppError(appId, err)
+	}
+	jujuManagedUnits := cfg.GetBool(caas.JujuManagedUnits, false)
+	updateStrategy := parseUpdateStrategy(cfg)
+	serviceBroker, err := p.config.Brokers.ServiceBroker(appId)
+	if err != nil {
+		return p.handleAppError(appId, err)
+	}
+	containerBroker, err := p.config.Brokers.ContainerBroker(appId)
+	if err != nil {
+		return p.handleAppError(appId, err)
+	}
+	aw, err := newApplicationWorker(
+		appId,
+		make(chan struct{}),
+		jujuManagedUnits,
+		serviceBroker,
+		containerBroker,
+		p.config.PodSpecGetter,
+		p.config.LifeGetter,
+		p.config.ApplicationGetter,
+		p.config.ApplicationUpdater,
+		p.config.UnitGetter,
+		p.config.UnitUpdater,
+		updateStrategy,
+		p.config.ReadinessGetter,
+	)
+	if err != nil {
+		return p.handleAppError(appId, err)
+	}
+	p.saveApplicationWorker(appId, aw)
+	p.catacomb.Add(aw)
+	p.retries.RecordSuccess(appId)
+	return nil
+}
+
+// resumePendingDeletions reloads the durable pending-deletion set via
+// ApplicationUpdater and re-drives cleanup for each entry before the main
+// loop starts watching for new changes. This is what actually lets cleanup
+// survive a provisioner restart: WatchApplications generally does not
+// redeliver applications that are already gone, so without this the
+// tombstone left by a previous process would never be acted on again.
+func (p *provisioner) resumePendingDeletions() error {
+	pending, err := p.config.ApplicationUpdater.PendingDeletions()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, pd := range pending {
+		p.mu.Lock()
+		p.pendingDeletions[pd.AppId] = pd.Substrate
+		p.mu.Unlock()
+		if err := p.processAppRemoved(pd.AppId); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// resolveCleanupSubstrate returns the substrate to use for cleaning up
+// appId: the one already recorded against a pending deletion if cleanup is
+// already in flight for it (including one resumed from a previous process),
+// otherwise the one in its current ApplicationConfig. If even
+// ApplicationConfig 404s (the application is entirely gone and this is the
+// first time this process has seen it), it falls back to defaultSubstrate,
+// since that's what an application would be using unless it opted out, and
+// the tombstone recorded below remembers the real answer from here on.
+func (p *provisioner) resolveCleanupSubstrate(appId string) (string, error) {
+	p.mu.Lock()
+	substrate, ok := p.pendingDeletions[appId]
+	p.mu.Unlock()
+	if ok {
+		return substrate, nil
+	}
+	cfg, err := p.config.ApplicationGetter.ApplicationConfig(appId)
+	if errors.IsNotFound(err) {
+		return defaultSubstrate, nil
+	}
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return cfg.GetString(substrateConfigKey, defaultSubstrate), nil
+}
+
+// processAppRemoved cleans up the service and ingress resources for an
+// application that LifeGetter no longer knows about. UnexposeService and
+// DeleteService are allowed to fail and be retried independently, without
+// losing track of the tombstone: pendingDeletions records that cleanup is
+// in flight, together with the substrate to clean it up against, and is
+// persisted via ApplicationUpdater so a restart resumes cleanup via
+// resumePendingDeletions instead of relying on the watcher.
+func (p *provisioner) processAppRemoved(appId string) error {
+	substrate, err := p.resolveCleanupSubstrate(appId)
+	if err != nil {
+		return p.handleAppRemovalError(appId, err)
+	}
+	p.markPendingDeletion(appId, substrate)
+
+	containerBroker, err := p.config.Brokers.ContainerBrokerForSubstrate(substrate)
+	if err != nil {
+		return p.handleAppRemovalError(appId, err)
+	}
+	if err := containerBroker.UnexposeService(appId); err != nil && !errors.IsNotFound(err) {
+		return p.handleAppRemovalError(appId, err)
+	}
+	if err := containerBroker.DeleteService(appId); err != nil && !errors.IsNotFound(err) {
+		return p.handleAppRemovalError(appId, err)
+	}
+	p.config.Brokers.Forget(appId)
+	p.clearPendingDeletion(appId)
+	p.retries.RecordSuccess(appId)
+
+	w, ok := p.getApplicationWorker(appId)
+	if ok {
+		// Before stopping the application worker, inform it that
+		// the app is gone so it has a chance to clean up.
+		// The worker will act on the removal prior to processing the
+		// Stop() request.
+		// We have to use a channel send here, rather than just closing the select, otherwise we
+		// effectively send the Stop() at the same time as the appRemoved signal.
+		// By sending a message, we block until it at least starts that routine
+		select {
+		case w.appRemoved <- struct{}{}:
+		case <-w.catacomb.Dying():
+			// If the catacomb is already dying, there is no guarantee that w.appRemoved will ever be
+			// seen. But we can still at least close the channel
+			close(w.appRemoved)
+		}
+		if err := worker.Stop(w); err != nil {
+			logger.Errorf("stopping application worker for %v: %v", appId, err)
+		}
+		p.deleteApplicationWorker(appId)
+	}
+	return nil
+}
+
+// handleAppError classifies a broker/API error for appId. Non-transient
+// errors short-circuit immediately; transient errors are handed to
+// p.retries, which schedules a backoff and trips a circuit breaker after
+// enough consecutive failures (the breaker still lets half-open probes
+// through on its own cooldown, so a recovered substrate is noticed without
+// restarting the provisioner). A non-transient error, or a transient one
+// that has just tripped the breaker, surfaces the application as failed via
+// ApplicationUpdater; other transient errors are only logged. The whole
+// worker is never killed.
+func (p *provisioner) handleAppError(appId string, err error) error {
+	if !isTransient(err) {
+		logger.Errorf("non-transient error provisioning application %v: %v", appId, err)
+		p.retries.RecordSuccess(appId)
+		p.reportProvisioningFailed(appId, err)
+		return nil
+	}
+	switch tripped := p.retries.RecordFailure(appId); {
+	case tripped:
+		logger.Errorf("circuit breaker tripped for application %v after repeated failures: %v", appId, err)
+		p.reportProvisioningFailed(appId, err)
+	case p.retries.IsTripped(appId):
+		logger.Warningf("half-open retry failed for application %v, circuit remains open: %v", appId, err)
+	default:
+		logger.Warningf("transient error provisioning application %v, will retry: %v", appId, err)
+	}
+	return nil
+}
+
+// handleAppRemovalError is handleAppError's counterpart for the cleanup
+// path. A non-transient failure here means cleanup is explicitly abandoned
+// (not silently left pending forever): the tombstone is cleared and the
+// application is surfaced as failed so an operator can intervene, rather
+// than leaving introspection reporting a cleanup that will never resolve.
+func (p *provisioner) handleAppRemovalError(appId string, err error) error {
+	if !isTransient(err) {
+		logger.Errorf("abandoning cleanup for application %v after non-transient error: %v", appId, err)
+		p.retries.RecordSuccess(appId)
+		p.clearPendingDeletion(appId)
+		p.reportProvisioningFailed(appId, err)
+		return nil
+	}
+	switch tripped := p.retries.RecordFailure(appId); {
+	case tripped:
+		logger.Errorf("circuit breaker tripped cleaning up application %v after repeated failures: %v", appId, err)
+		p.reportProvisioningFailed(appId, err)
+	case p.retries.IsTripped(appId):
+		logger.Warningf("half-open cleanup retry failed for application %v, circuit remains open: %v", appId, err)
+	default:
+		logger.Warningf("transient error cleaning up application %v, will retry: %v", appId, err)
+	}
+	return nil
+}
+
+// reportProvisioningFailed surfaces appId as failed via ApplicationUpdater
+// without killing the top-level worker.
+func (p *provisioner) reportProvisioningFailed(appId string, cause error) {
+	if err := p.config.ApplicationUpdater.UpdateApplicationStatus(appId, "provisioning failed", cause); err != nil {
+		logger.Errorf("updating status for application %v: %v", appId, err)
+	}
+}
+
+// markPendingDeletion records that cleanup of appId against substrate is in
+// flight, both locally and in the durable store behind ApplicationUpdater,
+// so a restart mid-cleanup can resume against the same substrate via
+// resumePendingDeletions.
+func (p *provisioner) markPendingDeletion(appId, substrate string) {
+	p.mu.Lock()
+	p.pendingDeletions[appId] = substrate
+	p.mu.Unlock()
+	if err := p.config.ApplicationUpdater.SetPendingDeletion(appId, substrate); err != nil {
+		logger.Errorf("persisting pending deletion for application %v: %v", appId, err)
+	}
+}
+
+func (p *provisioner) clearPendingDeletion(appId string) {
+	p.mu.Lock()
+	delete(p.pendingDeletions, appId)
+	p.mu.Unlock()
+	if err := p.config.ApplicationUpdater.ClearPendingDeletion(appId); err != nil {
+		logger.Errorf("clearing pending deletion for application %v: %v", appId, err)
+	}
+}